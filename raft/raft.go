@@ -30,12 +30,14 @@ const (
 	StateFollower StateType = iota
 	StateCandidate
 	StateLeader
+	StatePreCandidate
 )
 
 var stmap = [...]string{
 	"StateFollower",
 	"StateCandidate",
 	"StateLeader",
+	"StatePreCandidate",
 }
 
 func (st StateType) String() string {
@@ -79,6 +81,188 @@ type Config struct {
 	// Applied. If Applied is unset when restarting, raft might return previous
 	// applied entries. This is a very application dependent configuration.
 	Applied uint64
+
+	// PreVote enables the pre-vote algorithm described in raft thesis section
+	// 9.6. This prevents disruptive restarts / partitioned nodes from
+	// disturbing the stable raft cluster they used to belong to, by requiring
+	// a quorum of pre-votes before bumping the term and starting a real
+	// election.
+	PreVote bool
+
+	// CheckQuorum enables the leader to step down to follower if it has not
+	// heard from a quorum of peers within ElectionTick ticks. This makes the
+	// ReadIndex read path safe: without it a leader that is actually
+	// partitioned away from the cluster could keep answering ReadIndex
+	// requests as if it were still leader.
+	CheckQuorum bool
+
+	// MaxSizePerMsg limits the total byte size of the entries carried in a
+	// single MsgAppend. 0 means no limit.
+	MaxSizePerMsg uint64
+	// MaxInflightMsgs limits the number of in-flight (sent but not yet
+	// acknowledged) MsgAppend messages the leader keeps pipelined to a
+	// follower in StateReplicate.
+	MaxInflightMsgs int
+
+	// MaxUncommittedEntriesSize limits the aggregate byte size of proposed
+	// entries that have been appended to the leader's log but not yet
+	// committed. Proposals that would push a non-empty tail past this cap
+	// are rejected with ErrProposalDropped, so a slow follower sheds load
+	// instead of letting the leader's log grow without bound; a proposal
+	// arriving while the tail is empty is accepted whatever its size. 0
+	// means no limit. The leader's own noop entry from becomeLeader is exempt.
+	MaxUncommittedEntriesSize uint64
+}
+
+// ReadState is returned by a leader via Ready once it has confirmed, via a
+// quorum of heartbeat responses, that RequestCtx was requested while no
+// later entry had been committed than Index. The application should wait
+// for its applied index to reach Index before serving the read tied to
+// RequestCtx.
+type ReadState struct {
+	Index      uint64
+	RequestCtx []byte
+}
+
+// readIndexStatus tracks the in-flight quorum check for a single ReadIndex
+// request.
+type readIndexStatus struct {
+	req   pb.Message
+	index uint64
+	acks  map[uint64]bool
+}
+
+// readOnly buffers ReadIndex requests that are waiting for a heartbeat
+// round-trip with a quorum of peers before they can be answered.
+type readOnly struct {
+	pendingReadIndex map[string]*readIndexStatus
+	readIndexQueue   []string
+}
+
+func newReadOnly() *readOnly {
+	return &readOnly{
+		pendingReadIndex: make(map[string]*readIndexStatus),
+	}
+}
+
+// addRequest records a new ReadIndex request, keyed by its opaque context,
+// alongside the commit index it must be checked against.
+func (ro *readOnly) addRequest(index uint64, m pb.Message) {
+	ctx := string(m.Entries[0].Data)
+	if _, ok := ro.pendingReadIndex[ctx]; ok {
+		return
+	}
+	ro.pendingReadIndex[ctx] = &readIndexStatus{req: m, index: index, acks: make(map[uint64]bool)}
+	ro.readIndexQueue = append(ro.readIndexQueue, ctx)
+}
+
+// recvAck records that from acknowledged ctx and returns the full set of
+// distinct peers that have now acknowledged it (nil if ctx is unknown), so
+// the caller can check it against a real quorum rather than a raw count.
+func (ro *readOnly) recvAck(from uint64, ctx string) map[uint64]bool {
+	rs, ok := ro.pendingReadIndex[ctx]
+	if !ok {
+		return nil
+	}
+	rs.acks[from] = true
+	return rs.acks
+}
+
+// advance pops ctx, and every older still-pending request ahead of it in the
+// queue (they're now moot - their commit index is older than ctx's - see
+// etcd-raft readOnly.advance), returning the popped statuses in order.
+func (ro *readOnly) advance(ctx string) []*readIndexStatus {
+	var done []*readIndexStatus
+	for i, c := range ro.readIndexQueue {
+		rs, ok := ro.pendingReadIndex[c]
+		if !ok {
+			continue
+		}
+		done = append(done, rs)
+		delete(ro.pendingReadIndex, c)
+		if c == ctx {
+			ro.readIndexQueue = ro.readIndexQueue[i+1:]
+			break
+		}
+	}
+	return done
+}
+
+// Inflights is a sliding window ring buffer of the indexes of in-flight
+// MsgAppend messages sent to a single follower in StateReplicate, bounded by
+// Config.MaxInflightMsgs. It lets a leader pipeline appends without waiting
+// for each response while still capping how far ahead it can get.
+type Inflights struct {
+	start int
+	count int
+
+	size   int
+	buffer []uint64
+}
+
+func newInflights(size int) *Inflights {
+	return &Inflights{size: size}
+}
+
+// Add records that an append up to index inflight has just been sent.
+func (in *Inflights) Add(inflight uint64) {
+	if in.Full() {
+		panic("cannot add into a Full inflights")
+	}
+	next := in.start + in.count
+	if next >= in.size {
+		next -= in.size
+	}
+	if next >= len(in.buffer) {
+		in.grow()
+	}
+	in.buffer[next] = inflight
+	in.count++
+}
+
+func (in *Inflights) grow() {
+	newSize := len(in.buffer) * 2
+	if newSize == 0 {
+		newSize = 1
+	} else if newSize > in.size {
+		newSize = in.size
+	}
+	newBuffer := make([]uint64, newSize)
+	copy(newBuffer, in.buffer)
+	in.buffer = newBuffer
+}
+
+// FreeTo frees every inflight entry up to and including to - called once a
+// MsgAppendResponse confirms the follower has reached that index.
+func (in *Inflights) FreeTo(to uint64) {
+	if in.count == 0 || to < in.buffer[in.start] {
+		return
+	}
+
+	i, idx := 0, in.start
+	for ; i < in.count; i++ {
+		if to < in.buffer[idx] {
+			break
+		}
+		if idx++; idx >= in.size {
+			idx -= in.size
+		}
+	}
+	in.count -= i
+	in.start = idx
+	if in.count == 0 {
+		in.start = 0
+	}
+}
+
+// Full reports whether the window has reached Config.MaxInflightMsgs.
+func (in *Inflights) Full() bool {
+	return in.count == in.size
+}
+
+func (in *Inflights) reset() {
+	in.count = 0
+	in.start = 0
 }
 
 func (c *Config) validate() error {
@@ -101,10 +285,133 @@ func (c *Config) validate() error {
 	return nil
 }
 
+// ProgressStateType represents how a leader is currently replicating to a
+// given follower.
+type ProgressStateType uint64
+
+const (
+	// StateProbe means the leader sends at most one MsgAppend at a time and
+	// waits for the response before sending the next one, to discover the
+	// follower's actual log position.
+	StateProbe ProgressStateType = iota
+	// StateReplicate means the leader believes the follower is caught up:
+	// it keeps appending new entries and pipelines them within an inflight
+	// window without waiting for each response.
+	StateReplicate
+	// StateSnapshot means the leader has sent (or is about to send) a
+	// snapshot and pauses MsgAppend until the snapshot is acknowledged.
+	StateSnapshot
+)
+
+var prstmap = [...]string{
+	"StateProbe",
+	"StateReplicate",
+	"StateSnapshot",
+}
+
+func (st ProgressStateType) String() string {
+	return prstmap[uint64(st)]
+}
+
 // Progress represents a follower’s progress in the view of the leader. Leader maintains
 // progresses of all followers, and sends entries to the follower based on its progress.
 type Progress struct {
 	Match, Next uint64
+
+	// State determines how sendAppend paces messages to this peer: see
+	// ProgressStateType.
+	State ProgressStateType
+
+	// Paused is true while in StateProbe and a MsgAppend is already
+	// outstanding - sendAppend skips this peer until the next response (or
+	// rejection) clears it.
+	Paused bool
+
+	// PendingSnapshot, when non-zero, is the index of a snapshot this peer
+	// has been sent while in StateSnapshot; it is cleared once the peer
+	// catches up past it.
+	PendingSnapshot uint64
+
+	// Inflights is the sliding window of in-flight MsgAppend messages while
+	// in StateReplicate, capped at Config.MaxInflightMsgs.
+	Inflights *Inflights
+
+	// IsLearner marks this peer as a non-voting learner: it still receives
+	// MsgAppend and advances Match, but is excluded from vote and commit
+	// quorum counting.
+	IsLearner bool
+}
+
+// becomeProbe switches the peer back to StateProbe, e.g. after a rejection,
+// and resets Next to Match+1 (or just past a pending snapshot, if that is
+// further) to resume probing from there.
+func (pr *Progress) becomeProbe() {
+	if pr.State == StateSnapshot {
+		pendingSnapshot := pr.PendingSnapshot
+		pr.resetState(StateProbe)
+		pr.Next = max(pr.Match+1, pendingSnapshot+1)
+		return
+	}
+	pr.resetState(StateProbe)
+	pr.Next = pr.Match + 1
+}
+
+// becomeReplicate switches the peer to StateReplicate, typically once a
+// previously rejected probe succeeds.
+func (pr *Progress) becomeReplicate() {
+	pr.resetState(StateReplicate)
+	pr.Next = pr.Match + 1
+}
+
+// becomeSnapshot switches the peer to StateSnapshot, pausing MsgAppend until
+// the snapshot at the given index has been delivered and acknowledged.
+func (pr *Progress) becomeSnapshot(snapshotIndex uint64) {
+	pr.resetState(StateSnapshot)
+	pr.PendingSnapshot = snapshotIndex
+}
+
+func (pr *Progress) resetState(state ProgressStateType) {
+	pr.Paused = false
+	pr.PendingSnapshot = 0
+	pr.State = state
+	pr.Inflights.reset()
+}
+
+// maybeUpdate records that a MsgAppendResponse confirmed the follower has
+// entries up to n; it returns whether the progress actually advanced.
+func (pr *Progress) maybeUpdate(n uint64) bool {
+	if n <= pr.Match {
+		return false
+	}
+	pr.Match = n
+	if pr.Next < n+1 {
+		pr.Next = n + 1
+	}
+	return true
+}
+
+// maybeDecrTo tries to move Next back after a rejected MsgAppend; it returns
+// whether Next actually moved.
+func (pr *Progress) maybeDecrTo(rejected, lastIndex uint64) bool {
+	if pr.State == StateReplicate {
+		// The rejection is stale: either we've already advanced past it, or
+		// the follower actually has entries up to lastIndex (out of order
+		// delivery).
+		if rejected <= pr.Match {
+			return false
+		}
+		pr.Next = pr.Match + 1
+		return true
+	}
+
+	if pr.Next-1 != rejected {
+		return false
+	}
+	if pr.Next = min(rejected, lastIndex+1); pr.Next < 1 {
+		pr.Next = 1
+	}
+	pr.Paused = false
+	return true
 }
 
 type Raft struct {
@@ -116,9 +423,27 @@ type Raft struct {
 	// the log
 	RaftLog *RaftLog
 
-	// log replication progress of each peers
+	// log replication progress of each peers. Prs holds an entry for every
+	// peer this node currently tracks: incoming voters, outgoing voters
+	// (while a joint config change is in flight) and learners alike - see
+	// Voters, votersOutgoing and Progress.IsLearner.
 	Prs map[uint64]*Progress
 
+	// Voters is the incoming (i.e. post-change) set of voting peer IDs.
+	Voters map[uint64]bool
+
+	// votersOutgoing is non-empty only while a joint configuration change is
+	// in flight: it holds the previous (pre-change) voter set. Both Voters
+	// and votersOutgoing must independently reach quorum for a vote to be
+	// won or an entry to be committed, per the joint-consensus protocol.
+	votersOutgoing map[uint64]bool
+
+	// autoLeaveJoint records the autoLeave flag the in-flight joint config
+	// change was entered with. Nothing in this package reads it: no
+	// LeaveJoint entry is proposed automatically, and the joint state lasts
+	// until leaveJoint is called.
+	autoLeaveJoint bool
+
 	// this peer's role
 	State StateType
 
@@ -159,6 +484,37 @@ type Raft struct {
 	PendingConfIndex uint64
 
 	randomElectionTimeout int
+
+	// PreVote enables the pre-vote phase before a follower bumps its term
+	// and campaigns for real votes. See becomePreCandidate.
+	PreVote bool
+
+	// CheckQuorum enables the leader to step down once it has gone
+	// ElectionTick ticks without hearing from a quorum of peers.
+	CheckQuorum bool
+
+	// readOnly buffers in-flight ReadIndex requests, keyed by their opaque
+	// request context, until a quorum of heartbeat responses confirms them.
+	readOnly *readOnly
+
+	// readStates holds ReadIndex results ready to be surfaced to the
+	// application via Ready.
+	readStates []ReadState
+
+	// recentActive tracks, for a leader with CheckQuorum enabled, which
+	// peers have responded since the last electionTimeout window.
+	recentActive map[uint64]bool
+
+	// maxInflight caps the size of each peer's Inflights window.
+	maxInflight int
+	// maxMsgSize caps the total entry payload size of a single MsgAppend.
+	maxMsgSize uint64
+
+	// maxUncommittedSize caps uncommittedSize; 0 means no limit.
+	maxUncommittedSize uint64
+	// uncommittedSize is the aggregate byte size of proposed entries
+	// appended to the leader's log but not yet committed.
+	uncommittedSize uint64
 }
 
 // newRaft return a raft peer with the given config
@@ -171,16 +527,28 @@ func newRaft(c *Config) *Raft {
 	if c.peers == nil {
 		c.peers = confState.Nodes
 	}
+	maxInflight := c.MaxInflightMsgs
+	if maxInflight <= 0 {
+		maxInflight = 256
+	}
 	r := &Raft{
-		id:               c.ID,
-		Prs:              make(map[uint64]*Progress),
-		votes:            make(map[uint64]bool),
-		electionTimeout:  c.ElectionTick,
-		heartbeatTimeout: c.HeartbeatTick,
-		RaftLog:          newLog(c.Storage),
-		Vote:             hardState.Vote,
-		Term:             hardState.Term,
-		State:            StateFollower,
+		id:                 c.ID,
+		Prs:                make(map[uint64]*Progress),
+		Voters:             make(map[uint64]bool),
+		votes:              make(map[uint64]bool),
+		electionTimeout:    c.ElectionTick,
+		heartbeatTimeout:   c.HeartbeatTick,
+		RaftLog:            newLog(c.Storage),
+		Vote:               hardState.Vote,
+		Term:               hardState.Term,
+		State:              StateFollower,
+		PreVote:            c.PreVote,
+		CheckQuorum:        c.CheckQuorum,
+		readOnly:           newReadOnly(),
+		recentActive:       make(map[uint64]bool),
+		maxInflight:        maxInflight,
+		maxMsgSize:         c.MaxSizePerMsg,
+		maxUncommittedSize: c.MaxUncommittedEntriesSize,
 	}
 
 	if c.Applied > 0 {
@@ -188,11 +556,8 @@ func newRaft(c *Config) *Raft {
 	}
 	//DPrintf("NewRaft-%d vote-%d", r.id, r.Vote)
 	for _, peer := range c.peers {
-		if peer == r.id {
-			r.Prs[peer] = &Progress{Next: r.RaftLog.LastIndex() + 1}
-		} else {
-			r.Prs[peer] = &Progress{Next: r.RaftLog.LastIndex() + 1}
-		}
+		r.Prs[peer] = &Progress{Next: r.RaftLog.LastIndex() + 1, Inflights: newInflights(r.maxInflight)}
+		r.Voters[peer] = true
 	}
 
 	//r.becomeFollower(0, None)
@@ -218,15 +583,53 @@ func (r *Raft) hardState() pb.HardState {
 
 // sendAppend sends an append RPC with new entries (if any) and the
 // current commit index to the given peer. Returns true if a message was sent.
+// Pacing is governed by the peer's Progress: StateProbe sends a single
+// MsgAppend and pauses until the response; StateReplicate pipelines sends up
+// to the peer's Inflights window; StateSnapshot sends nothing.
 func (r *Raft) sendAppend(to uint64) bool {
 	// Your Code Here (2A).
-	prevLogIndex := r.Prs[to].Next - 1
+	pr := r.Prs[to]
+	if pr.State == StateSnapshot {
+		return false
+	}
+	if pr.State == StateProbe && pr.Paused {
+		return false
+	}
+	if pr.State == StateReplicate && pr.Inflights.Full() {
+		return false
+	}
 
-	prevLogTerm, _ := r.RaftLog.Term(prevLogIndex)
+	prevLogIndex := pr.Next - 1
+
+	prevLogTerm, err := r.RaftLog.Term(prevLogIndex)
+	if err != nil {
+		// prevLogIndex has already been compacted out of the log: a
+		// MsgAppend can't carry a valid LogTerm for it, so pause replication
+		// and send a snapshot instead.
+		snapshot, err := r.RaftLog.Snapshot()
+		if err != nil {
+			return false
+		}
+		pr.becomeSnapshot(snapshot.Metadata.Index)
+		r.msgs = append(r.msgs, pb.Message{
+			MsgType:  pb.MessageType_MsgSnapshot,
+			To:       to,
+			From:     r.id,
+			Term:     r.Term,
+			Snapshot: &snapshot,
+		})
+		return true
+	}
 
 	var ents []*pb.Entry
+	var size uint64
 	for i := prevLogIndex + 1; i < r.RaftLog.LastIndex()+1; i++ {
-		ents = append(ents, &r.RaftLog.entries[r.RaftLog.toSliceIndex(i)])
+		entry := &r.RaftLog.entries[r.RaftLog.toSliceIndex(i)]
+		if r.maxMsgSize > 0 && len(ents) > 0 && size+uint64(len(entry.Data)) > r.maxMsgSize {
+			break
+		}
+		ents = append(ents, entry)
+		size += uint64(len(entry.Data))
 	}
 	//DPrintf("to-%d len(entries): %d", to, len(ents))
 
@@ -241,6 +644,16 @@ func (r *Raft) sendAppend(to uint64) bool {
 		Commit:  r.RaftLog.committed,
 	}
 	r.msgs = append(r.msgs, msg)
+
+	if len(ents) > 0 {
+		last := ents[len(ents)-1].Index
+		switch pr.State {
+		case StateProbe:
+			pr.Paused = true
+		case StateReplicate:
+			pr.Inflights.Add(last)
+		}
+	}
 	return true
 }
 
@@ -258,46 +671,63 @@ func (r *Raft) sendAppendResponse(to uint64, reject bool, conflictIndex uint64,
 	r.msgs = append(r.msgs, msg)
 }
 
-// sendHeartbeat sends a heartbeat RPC to the given peer.
-func (r *Raft) sendHeartbeat(to uint64) {
+// sendHeartbeat sends a heartbeat RPC to the given peer, optionally carrying
+// a pending ReadIndex request context that the peer is expected to echo back
+// in its response.
+func (r *Raft) sendHeartbeat(to uint64, ctx []byte) {
 	// Your Code Here (2A).
 	msg := pb.Message{
 		MsgType: pb.MessageType_MsgHeartbeat,
 		To:      to,
 		From:    r.id,
 		Term:    r.Term,
+		Context: ctx,
 	}
 	r.msgs = append(r.msgs, msg)
 }
 
-func (r *Raft) sendHeartbeatResponse(to uint64, reject bool) {
+func (r *Raft) sendHeartbeatResponse(to uint64, reject bool, ctx []byte) {
 	msg := pb.Message{
 		MsgType: pb.MessageType_MsgHeartbeatResponse,
 		To:      to,
 		From:    r.id,
 		Term:    r.Term,
 		Reject:  reject,
+		Context: ctx,
 	}
 	r.msgs = append(r.msgs, msg)
 }
 
-func (r *Raft) sendRequestVote(to uint64) {
+// sendRequestVote sends a MsgRequestVote RPC to the given peer. When
+// preVote is true a MsgPreVote is sent instead, carrying Term = r.Term + 1
+// without actually bumping r.Term (see becomePreCandidate).
+func (r *Raft) sendRequestVote(to uint64, preVote bool) {
 	lastLogIndex := r.RaftLog.LastIndex()
 	lastLogTerm, _ := r.RaftLog.Term(lastLogIndex)
+	term := r.Term
+	msgType := pb.MessageType_MsgRequestVote
+	if preVote {
+		msgType = pb.MessageType_MsgPreVote
+		term = r.Term + 1
+	}
 	msg := pb.Message{
-		MsgType: pb.MessageType_MsgRequestVote,
+		MsgType: msgType,
 		To:      to,
 		From:    r.id,
-		Term:    r.Term,
+		Term:    term,
 		Index:   lastLogIndex,
 		LogTerm: lastLogTerm,
 	}
 	r.msgs = append(r.msgs, msg)
 }
 
-func (r *Raft) sendRequestVoteResponse(to uint64, reject bool) {
+func (r *Raft) sendRequestVoteResponse(to uint64, preVote bool, reject bool) {
+	msgType := pb.MessageType_MsgRequestVoteResponse
+	if preVote {
+		msgType = pb.MessageType_MsgPreVoteResponse
+	}
 	msg := pb.Message{
-		MsgType: pb.MessageType_MsgRequestVoteResponse,
+		MsgType: msgType,
 		To:      to,
 		From:    r.id,
 		Term:    r.Term,
@@ -306,13 +736,23 @@ func (r *Raft) sendRequestVoteResponse(to uint64, reject bool) {
 	r.msgs = append(r.msgs, msg)
 }
 
+// sendTimeoutNow tells to to start an election immediately, without waiting
+// out its election timeout, as the final step of a leader transfer.
+func (r *Raft) sendTimeoutNow(to uint64) {
+	msg := pb.Message{
+		MsgType: pb.MessageType_MsgTimeoutNow,
+		To:      to,
+		From:    r.id,
+		Term:    r.Term,
+	}
+	r.msgs = append(r.msgs, msg)
+}
+
 // tick advances the internal logical clock by a single tick.
 func (r *Raft) tick() {
 	// Your Code Here (2A).
 	switch r.State {
-	case StateFollower:
-		r.tickElection()
-	case StateCandidate:
+	case StateFollower, StateCandidate, StatePreCandidate:
 		r.tickElection()
 	case StateLeader:
 		r.tickHeartBeat()
@@ -331,12 +771,42 @@ func (r *Raft) tickElection() {
 
 func (r *Raft) tickHeartBeat() {
 	r.heartbeatElapsed++
+	if r.CheckQuorum || r.leadTransferee != None {
+		r.electionElapsed++
+	}
 	if r.heartbeatElapsed >= r.heartbeatTimeout {
 		r.heartbeatElapsed = 0
 		r.Step(pb.Message{
 			MsgType: pb.MessageType_MsgBeat,
 		})
 	}
+	// Reset once up front and run both checks off the same window: resetting
+	// inside one branch before the other reads electionElapsed would make
+	// that other check's "within one election timeout" never actually fire.
+	if r.electionElapsed < r.electionTimeout {
+		return
+	}
+	r.electionElapsed = 0
+
+	// CheckQuorum: if we haven't heard from a quorum of peers within an
+	// election timeout, step down rather than keep answering ReadIndex
+	// requests as if we were still a legitimate leader.
+	// Only voters count, and while a joint change is in flight both the
+	// incoming and the outgoing voter set must each have an active majority.
+	if r.CheckQuorum {
+		r.recentActive[r.id] = true // ourselves
+		active := r.recentActive
+		r.recentActive = make(map[uint64]bool)
+		if !quorumGranted(r.Voters, active) || !quorumGranted(r.votersOutgoing, active) {
+			r.becomeFollower(r.Term, None)
+			return
+		}
+	}
+	// A leader transfer that hasn't completed within one election timeout is
+	// abandoned: the transferee may be unreachable or stuck catching up.
+	if r.leadTransferee != None {
+		r.leadTransferee = None
+	}
 }
 
 // becomeFollower transform this peer's state to Follower
@@ -346,6 +816,8 @@ func (r *Raft) becomeFollower(term uint64, lead uint64) {
 	r.Term = term
 	r.Lead = lead
 	r.Vote = None
+	r.uncommittedSize = 0
+	r.leadTransferee = None
 }
 
 // becomeCandidate transform this peer's state to candidate
@@ -357,6 +829,18 @@ func (r *Raft) becomeCandidate() {
 	r.Vote = r.id
 	r.votes = make(map[uint64]bool)
 	r.votes[r.id] = true
+	r.uncommittedSize = 0
+}
+
+// becomePreCandidate transforms this peer's state to StatePreCandidate. Unlike
+// becomeCandidate, it does not bump r.Term nor reset r.Vote: a pre-candidate
+// is only probing whether it could win an election, so losing a pre-vote
+// round must leave the node's term untouched.
+func (r *Raft) becomePreCandidate() {
+	r.State = StatePreCandidate
+	r.Lead = None
+	r.votes = make(map[uint64]bool)
+	r.votes[r.id] = true
 }
 
 // becomeLeader transform this peer's state to leader
@@ -365,7 +849,10 @@ func (r *Raft) becomeLeader() {
 	// NOTE: Leader should propose a noop entry on its term
 	r.State = StateLeader
 	r.heartbeatElapsed = 0
+	r.electionElapsed = 0
 	r.Lead = r.id
+	r.recentActive = make(map[uint64]bool)
+	r.readOnly = newReadOnly()
 
 	r.votes = make(map[uint64]bool)
 
@@ -373,19 +860,95 @@ func (r *Raft) becomeLeader() {
 		if prs == r.id {
 			r.Prs[prs].Next = r.RaftLog.LastIndex() + 2
 			r.Prs[prs].Match = r.Prs[prs].Next - 1
+			r.Prs[prs].becomeReplicate()
 		} else {
+			r.Prs[prs].becomeProbe()
 			r.Prs[prs].Next = r.RaftLog.LastIndex() + 1
 		}
 	}
 
 	//DPrintf("last-index-%d", r.RaftLog.LastIndex())
 	r.RaftLog.entries = append(r.RaftLog.entries, pb.Entry{Term: r.Term, Index: r.RaftLog.LastIndex() + 1})
-	if len(r.Prs) == 1 {
+	if r.isSoleVoter() {
 		r.RaftLog.committed = r.RaftLog.LastIndex()
 	}
 	r.broadcastAppend()
 }
 
+// isSoleVoter reports whether this node is the only voter in every config
+// currently in effect (i.e. it can commit/win elections unilaterally).
+func (r *Raft) isSoleVoter() bool {
+	if len(r.Voters) != 1 || !r.Voters[r.id] {
+		return false
+	}
+	if len(r.votersOutgoing) == 0 {
+		return true
+	}
+	return len(r.votersOutgoing) == 1 && r.votersOutgoing[r.id]
+}
+
+// votingPeers returns every peer ID that is a voter in either the incoming
+// or the (if a joint change is in flight) outgoing configuration.
+func (r *Raft) votingPeers() map[uint64]bool {
+	if len(r.votersOutgoing) == 0 {
+		return r.Voters
+	}
+	peers := make(map[uint64]bool, len(r.Voters)+len(r.votersOutgoing))
+	for id := range r.Voters {
+		peers[id] = true
+	}
+	for id := range r.votersOutgoing {
+		peers[id] = true
+	}
+	return peers
+}
+
+// quorumGranted reports whether cfg has reached a majority of grants in
+// votes, i.e. cfg is satisfied. An empty cfg (no outgoing config) trivially
+// passes.
+func quorumGranted(cfg map[uint64]bool, votes map[uint64]bool) bool {
+	if len(cfg) == 0 {
+		return true
+	}
+	granted := 0
+	for id := range cfg {
+		if v, ok := votes[id]; ok && v {
+			granted++
+		}
+	}
+	return granted >= len(cfg)/2+1
+}
+
+// quorumLost reports whether cfg has reached a majority of explicit
+// rejections in votes.
+func quorumLost(cfg map[uint64]bool, votes map[uint64]bool) bool {
+	if len(cfg) == 0 {
+		return false
+	}
+	rejected := 0
+	for id := range cfg {
+		if v, ok := votes[id]; ok && !v {
+			rejected++
+		}
+	}
+	return rejected >= len(cfg)/2+1
+}
+
+// matchQuorum reports whether cfg has a majority of peers whose Progress.Match
+// is at least index. An empty cfg (no outgoing config) trivially passes.
+func (r *Raft) matchQuorum(cfg map[uint64]bool, index uint64) bool {
+	if len(cfg) == 0 {
+		return true
+	}
+	count := 0
+	for id := range cfg {
+		if pr, ok := r.Prs[id]; ok && pr.Match >= index {
+			count++
+		}
+	}
+	return count >= len(cfg)/2+1
+}
+
 func (r *Raft) broadcastAppend() {
 	for peer := range r.Prs {
 		if peer == r.id {
@@ -401,11 +964,11 @@ func (r *Raft) Step(m pb.Message) error {
 	// Your Code Here (2A).
 	switch r.State {
 	case StateFollower:
-		r.stepFollower(m)
-	case StateCandidate:
-		r.stepCandidate(m)
+		return r.stepFollower(m)
+	case StateCandidate, StatePreCandidate:
+		return r.stepCandidate(m)
 	case StateLeader:
-		r.stepLeader(m)
+		return r.stepLeader(m)
 	}
 	return nil
 }
@@ -421,12 +984,32 @@ func (r *Raft) stepFollower(m pb.Message) error {
 	case pb.MessageType_MsgAppendResponse:
 	case pb.MessageType_MsgRequestVote:
 		r.handleRequestVote(m)
+	case pb.MessageType_MsgPreVote:
+		r.handleRequestVote(m)
 	case pb.MessageType_MsgHeartbeat:
 		r.handleHeartbeat(m)
+	case pb.MessageType_MsgReadIndex:
+		if r.Lead != None {
+			m.To = r.Lead
+			r.msgs = append(r.msgs, m)
+		}
+	case pb.MessageType_MsgTransferLeader:
+		if r.Lead != None {
+			m.To = r.Lead
+			r.msgs = append(r.msgs, m)
+		}
+	case pb.MessageType_MsgTimeoutNow:
+		// The outgoing leader has confirmed we're caught up: campaign right
+		// away, skipping pre-vote, instead of waiting out electionElapsed.
+		r.campaign(false)
 	}
 	return nil
 }
 
+// stepCandidate handles messages for both StateCandidate and
+// StatePreCandidate: the two only differ in which response they wait for and
+// whether winning leads to a real candidacy (pre-candidate) or to leadership
+// (candidate).
 func (r *Raft) stepCandidate(m pb.Message) error {
 	switch m.MsgType {
 	case pb.MessageType_MsgHup:
@@ -441,10 +1024,26 @@ func (r *Raft) stepCandidate(m pb.Message) error {
 	case pb.MessageType_MsgAppendResponse:
 	case pb.MessageType_MsgRequestVote:
 		r.handleRequestVote(m)
+	case pb.MessageType_MsgPreVote:
+		r.handleRequestVote(m)
 	case pb.MessageType_MsgRequestVoteResponse:
-		r.handleRequestVoteResponse(m)
+		if r.State == StateCandidate {
+			r.handleRequestVoteResponse(m, false)
+		}
+	case pb.MessageType_MsgPreVoteResponse:
+		if r.State == StatePreCandidate {
+			r.handleRequestVoteResponse(m, true)
+		}
 	case pb.MessageType_MsgHeartbeat:
 		r.handleHeartbeat(m)
+	case pb.MessageType_MsgReadIndex:
+		// No leader to forward to while campaigning; the caller should retry.
+	case pb.MessageType_MsgTransferLeader:
+		// No leader to forward to while campaigning; drop it.
+	case pb.MessageType_MsgTimeoutNow:
+		// The outgoing leader has confirmed we're caught up: campaign right
+		// away, skipping pre-vote, instead of waiting out electionElapsed.
+		r.campaign(false)
 	}
 	return nil
 }
@@ -457,91 +1056,166 @@ func (r *Raft) stepLeader(m pb.Message) error {
 			if peer == r.id {
 				continue
 			}
-			r.sendHeartbeat(peer)
+			r.sendHeartbeat(peer, nil)
 		}
 
 	case pb.MessageType_MsgPropose:
-		r.handlePropose(m)
+		return r.handlePropose(m)
 	case pb.MessageType_MsgAppend:
 		r.handleAppendEntries(m)
 	case pb.MessageType_MsgAppendResponse:
 		r.handleAppendEntriesResponse(m)
 	case pb.MessageType_MsgRequestVote:
 		r.handleRequestVote(m)
+	case pb.MessageType_MsgPreVote:
+		r.handleRequestVote(m)
 	case pb.MessageType_MsgRequestVoteResponse:
-		r.handleRequestVoteResponse(m)
+		r.handleRequestVoteResponse(m, false)
 	case pb.MessageType_MsgHeartbeat:
 		r.handleHeartbeat(m)
 	case pb.MessageType_MsgHeartbeatResponse:
+		r.recentActive[m.From] = true
 		r.sendAppend(m.From)
+		r.handleHeartbeatResponse(m)
+	case pb.MessageType_MsgReadIndex:
+		r.handleReadIndex(m)
+	case pb.MessageType_MsgTransferLeader:
+		r.handleTransferLeader(m)
 	}
 	return nil
 }
 
+// doElection starts a normal campaign, running a pre-vote round first when
+// r.PreVote is enabled.
 func (r *Raft) doElection() {
-	r.becomeCandidate()
+	r.campaign(r.PreVote)
+}
+
+// campaign starts an election, optionally preceded by a pre-vote round. A
+// MsgTimeoutNow-triggered transfer election always calls campaign(false) to
+// skip pre-vote and start immediately, since the outgoing leader has already
+// confirmed this node's log is caught up.
+func (r *Raft) campaign(preVote bool) {
+	if preVote {
+		r.becomePreCandidate()
+	} else {
+		r.becomeCandidate()
+	}
 	r.electionElapsed = 0
 	r.randomElectionTimeout = r.electionTimeout + rand.Intn(r.electionTimeout)
 
-	if len(r.Prs) == 1 {
+	if r.isSoleVoter() {
+		if preVote {
+			r.becomeCandidate()
+		}
 		r.becomeLeader()
 		return
 	}
-	for peer := range r.Prs {
+	for peer := range r.votingPeers() {
 		if peer == r.id {
 			continue
 		}
-		r.sendRequestVote(peer)
+		r.sendRequestVote(peer, preVote)
 	}
-
 }
 
 func (r *Raft) handleRequestVote(m pb.Message) {
+	preVote := m.MsgType == pb.MessageType_MsgPreVote
 	//DPrintf("rf-%d receive vote from rf-%d, term-%d index-%d logTerm-%d", m.To, m.From, m.Term, m.Index, m.LogTerm)
 	//DPrintf("rf-%d term-%d vote-%d", r.id, r.Term, r.Vote)
-	if m.Term < r.Term || (m.Term == r.Term && r.Vote != None && r.Vote != m.From) {
+	if m.Term < r.Term {
 		//DPrintf("rf-%d reject1 rf-%d", m.To, m.From)
-		r.sendRequestVoteResponse(m.From, true)
+		r.sendRequestVoteResponse(m.From, preVote, true)
 		return
 	}
 
-	if m.Term > r.Term {
+	if !r.votingPeers()[m.From] {
+		// A learner (or a peer outside every config we track) is never
+		// eligible to become leader, so never grant it a vote.
+		r.sendRequestVoteResponse(m.From, preVote, true)
+		return
+	}
+
+	// A pre-vote request never mutates our term or vote: granting it only
+	// confirms the candidate's log looks electable, it does not commit us to
+	// anything. It's also only granted when we believe the current leader,
+	// if any, may be down - otherwise a partitioned node would keep forcing
+	// pre-vote rounds against a healthy leader.
+	if preVote {
+		// Reject regardless of how m.Term compares to r.Term: a partitioned
+		// candidate's idle log keeps it tied on the log check, so only the
+		// lease (we've heard from a leader within the last election timeout)
+		// stops it from forcing a disruptive election once it's back in
+		// contact.
+		if r.Lead != None && r.electionElapsed < r.electionTimeout {
+			r.sendRequestVoteResponse(m.From, true, true)
+			return
+		}
+	} else if m.Term == r.Term && r.Vote != None && r.Vote != m.From {
+		//DPrintf("rf-%d reject1 rf-%d", m.To, m.From)
+		r.sendRequestVoteResponse(m.From, false, true)
+		return
+	}
+
+	if m.Term > r.Term && !preVote {
 		r.becomeFollower(m.Term, None)
 	}
-	r.electionElapsed = 0
-	r.randomElectionTimeout = r.electionTimeout + rand.Intn(r.electionTimeout)
 
 	lastLogIndex := r.RaftLog.LastIndex()
 	lastLogTerm, _ := r.RaftLog.Term(lastLogIndex)
 	if m.LogTerm < lastLogTerm || (m.LogTerm == lastLogTerm && m.Index < lastLogIndex) {
 		//DPrintf("rf-%d reject2 rf-%d", m.To, m.From)
-		r.sendRequestVoteResponse(m.From, true)
+		r.sendRequestVoteResponse(m.From, preVote, true)
 		return
 	}
 	//DPrintf("rf-%d term-%d vote-%d lastLogIndex-%d lastLogTerm-%d", r.id, r.Term, r.Vote, lastLogIndex, lastLogTerm)
 
+	r.electionElapsed = 0
+	r.randomElectionTimeout = r.electionTimeout + rand.Intn(r.electionTimeout)
+
+	if preVote {
+		// Granting a pre-vote does not record a vote for this term.
+		r.sendRequestVoteResponse(m.From, true, false)
+		return
+	}
+
 	//DPrintf("rf-%d vote for rf-%d", m.To, m.From)
 	r.Term = m.Term
 	r.Vote = m.From
-	r.sendRequestVoteResponse(m.From, false)
+	r.sendRequestVoteResponse(m.From, false, false)
 }
 
-func (r *Raft) handleRequestVoteResponse(m pb.Message) {
+func (r *Raft) handleRequestVoteResponse(m pb.Message, preVote bool) {
 	r.votes[m.From] = !m.Reject
-	voteCount := 0
-	for _, item := range r.votes {
-		if item {
-			voteCount++
-		}
-		// win the election
-		if voteCount >= len(r.Prs)/2+1 {
-			r.becomeLeader()
+
+	// Both the incoming and (if a joint config change is in flight) the
+	// outgoing voter set must independently reach quorum.
+	if quorumGranted(r.Voters, r.votes) && quorumGranted(r.votersOutgoing, r.votes) {
+		if preVote {
+			// Won the pre-vote: now campaign for real, bumping the term.
+			r.becomeCandidate()
+			r.electionElapsed = 0
+			r.randomElectionTimeout = r.electionTimeout + rand.Intn(r.electionTimeout)
+			for peer := range r.votingPeers() {
+				if peer == r.id {
+					continue
+				}
+				r.sendRequestVote(peer, false)
+			}
 			return
 		}
+		r.becomeLeader()
+		return
 	}
 
-	// lose the election
-	if len(r.votes)-voteCount >= len(r.Prs)/2+1 {
+	// lose the election / pre-election
+	if quorumLost(r.Voters, r.votes) || quorumLost(r.votersOutgoing, r.votes) {
+		if preVote {
+			// Losing the pre-vote leaves our term untouched: we just go back
+			// to being a follower and wait for the next election timeout.
+			r.becomeFollower(r.Term, r.Lead)
+			return
+		}
 		r.becomeFollower(m.Term, None)
 	}
 
@@ -606,34 +1280,63 @@ func (r *Raft) handleAppendEntries(m pb.Message) {
 }
 
 func (r *Raft) handleAppendEntriesResponse(m pb.Message) {
-	if m.Reject && m.Index == r.Prs[m.From].Next-1 {
-		r.Prs[m.From].Next -= 1
-		r.sendAppend(m.From)
+	r.recentActive[m.From] = true
+	pr, ok := r.Prs[m.From]
+	if !ok {
+		// A stale response from a peer removeNode already dropped.
 		return
 	}
 
-	term, _ := r.RaftLog.Term(m.Index)
-	if term != r.Term || m.Index < r.Prs[m.From].Next {
+	if m.Reject {
+		if pr.maybeDecrTo(m.Index, r.RaftLog.LastIndex()) {
+			// Only a transition out of StateReplicate needs becomeProbe: it
+			// already set Next precisely via the decrement-by-one backoff,
+			// and becomeProbe would overwrite that with a jump to Match+1.
+			if pr.State == StateReplicate {
+				pr.becomeProbe()
+			}
+			r.sendAppend(m.From)
+		}
 		return
 	}
 
-	r.Prs[m.From].Match = m.Index
-	r.Prs[m.From].Next = m.Index + 1
+	term, _ := r.RaftLog.Term(m.Index)
+	if term != r.Term || !pr.maybeUpdate(m.Index) {
+		return
+	}
 	//DPrintf("r-%d here2 next-%d", m.From, r.Prs[m.From].Next)
 
+	switch pr.State {
+	case StateProbe:
+		pr.becomeReplicate()
+	case StateReplicate:
+		pr.Inflights.FreeTo(m.Index)
+	case StateSnapshot:
+		// The peer has caught up to the snapshot it was sent: resume
+		// probing from there.
+		if pr.Match >= pr.PendingSnapshot {
+			pr.becomeProbe()
+		}
+	}
+	// Replication is pipelined: keep pushing further entries, if any,
+	// without waiting for this response's sender to ask again.
+	r.sendAppend(m.From)
+
+	if r.leadTransferee == m.From && pr.Match == r.RaftLog.LastIndex() {
+		// The transferee just caught up: hand off leadership now.
+		r.sendTimeoutNow(m.From)
+		r.leadTransferee = None
+	}
+
 	for index := r.RaftLog.LastIndex(); index >= r.RaftLog.FirstIndex(); index-- {
-		sum := 0
-		for i := range r.Prs {
-			if i == r.id {
-				sum += 1
-				continue
-			}
-			if r.Prs[i].Match >= index {
-				sum += 1
-			}
+		// A joint config change requires a majority of BOTH the incoming and
+		// outgoing voter sets before an entry can be considered committed.
+		if !r.matchQuorum(r.Voters, index) || !r.matchQuorum(r.votersOutgoing, index) {
+			continue
 		}
 		commitTerm, _ := r.RaftLog.Term(index)
-		if sum >= len(r.Prs)/2+1 && commitTerm == r.Term && index > r.RaftLog.committed {
+		if commitTerm == r.Term && index > r.RaftLog.committed {
+			r.reduceUncommittedSize(r.RaftLog.committed, index)
 			r.RaftLog.committed = index
 			//DPrintf("leader-commit-%d", r.RaftLog.committed)
 			r.broadcastAppend()
@@ -642,9 +1345,67 @@ func (r *Raft) handleAppendEntriesResponse(m pb.Message) {
 	}
 }
 
-func (r *Raft) handlePropose(m pb.Message) {
+// handleTransferLeader handles a MsgTransferLeader request at the leader,
+// implementing section 3.10 of the raft thesis: if the transferee is
+// already caught up, hand off immediately via MsgTimeoutNow; otherwise catch
+// it up first and let handleAppendEntriesResponse finish the handoff once it
+// has.
+func (r *Raft) handleTransferLeader(m pb.Message) {
+	if m.From == r.id {
+		return
+	}
+	pr, ok := r.Prs[m.From]
+	if !ok || pr.IsLearner || !r.Voters[m.From] {
+		// transferee is not a voter in the current configuration
+		return
+	}
+	if r.leadTransferee == m.From {
+		return
+	}
+	r.leadTransferee = m.From
+	r.electionElapsed = 0
+	if pr.Match == r.RaftLog.LastIndex() {
+		r.sendTimeoutNow(m.From)
+	} else {
+		r.sendAppend(m.From)
+	}
+}
+
+func (r *Raft) handlePropose(m pb.Message) error {
+	// Section 3.10: once we've started transferring leadership away, stop
+	// accepting new proposals so the log doesn't keep growing past what the
+	// transferee has caught up to.
+	if r.leadTransferee != None {
+		return ErrProposalDropped
+	}
+
+	// Only one joint config change may be pending (proposed but not yet
+	// applied) at a time; drop any extra ones before accounting for their
+	// size, so a dropped entry's bytes are never charged against
+	// uncommittedSize (they'd never be appended, so reduceUncommittedSize
+	// could never reclaim them). pendingConfIndex is threaded through this
+	// single pass, rather than checked against r.PendingConfIndex on every
+	// entry, so a second ConfChangeV2 later in the very same batch is also
+	// dropped instead of slipping through the invariant.
 	lastIndex := r.RaftLog.LastIndex()
-	for i, entry := range m.Entries {
+	pendingConfIndex := r.PendingConfIndex
+	var entries []*pb.Entry
+	for _, entry := range m.Entries {
+		if entry.EntryType == pb.EntryType_EntryConfChangeV2 {
+			if pendingConfIndex > r.RaftLog.applied {
+				continue
+			}
+			pendingConfIndex = lastIndex + uint64(len(entries)) + 1
+		}
+		entries = append(entries, entry)
+	}
+
+	if err := r.increaseUncommittedSize(entries); err != nil {
+		return err
+	}
+	r.PendingConfIndex = pendingConfIndex
+
+	for i, entry := range entries {
 		entry.Term = r.Term
 		entry.Index = lastIndex + uint64(i) + 1
 		r.RaftLog.entries = append(r.RaftLog.entries, *entry)
@@ -654,27 +1415,117 @@ func (r *Raft) handlePropose(m pb.Message) {
 	//DPrintf("propose commit-%d before", r.RaftLog.committed)
 	r.broadcastAppend()
 	//DPrintf("propose commit-%d after", r.RaftLog.committed)
-	if len(r.Prs) == 1 {
+	if r.isSoleVoter() {
+		r.reduceUncommittedSize(r.RaftLog.committed, r.RaftLog.LastIndex())
 		r.RaftLog.committed = r.RaftLog.LastIndex()
 	}
 
+	return nil
+}
+
+// increaseUncommittedSize accounts for ents against the uncommitted log tail
+// size cap, rejecting the proposal if it would push a non-empty tail over
+// maxUncommittedSize; while the tail is empty any proposal is accepted. A cap
+// of 0 disables the check, and an empty (noop) proposal is always exempt so
+// that leader election can never be blocked by a full tail.
+func (r *Raft) increaseUncommittedSize(ents []*pb.Entry) error {
+	if r.maxUncommittedSize == 0 {
+		return nil
+	}
+	var size uint64
+	for _, ent := range ents {
+		size += uint64(len(ent.Data))
+	}
+	if size == 0 {
+		return nil
+	}
+	if r.uncommittedSize > 0 && r.uncommittedSize+size > r.maxUncommittedSize {
+		return ErrProposalDropped
+	}
+	r.uncommittedSize += size
+	return nil
+}
+
+// reduceUncommittedSize accounts for entries between the old and new commit
+// index leaving the uncommitted tail.
+func (r *Raft) reduceUncommittedSize(from, to uint64) {
+	if r.maxUncommittedSize == 0 {
+		return
+	}
+	var size uint64
+	for i := from + 1; i <= to; i++ {
+		if i < r.RaftLog.FirstIndex() || i > r.RaftLog.LastIndex() {
+			continue
+		}
+		entry := r.RaftLog.entries[r.RaftLog.toSliceIndex(i)]
+		size += uint64(len(entry.Data))
+	}
+	if size > r.uncommittedSize {
+		r.uncommittedSize = 0
+		return
+	}
+	r.uncommittedSize -= size
 }
 
 // handleHeartbeat handle Heartbeat RPC request
 func (r *Raft) handleHeartbeat(m pb.Message) {
 	// Your Code Here (2A).
 	if m.Term != None && m.Term < r.Term {
-		r.sendHeartbeatResponse(m.From, true)
+		r.sendHeartbeatResponse(m.From, true, nil)
 		return
 	}
 	r.Lead = m.From
 	r.electionElapsed = 0
 	r.randomElectionTimeout = r.electionTimeout + rand.Intn(r.electionTimeout)
-	r.sendHeartbeatResponse(m.From, false)
+	r.sendHeartbeatResponse(m.From, false, m.Context)
 }
 
+// handleHeartbeatResponse processes the Context a follower echoed back, if
+// any, advancing any ReadIndex requests that have now reached quorum.
 func (r *Raft) handleHeartbeatResponse(m pb.Message) {
+	if len(m.Context) == 0 {
+		return
+	}
+	ctx := string(m.Context)
+	acks := r.readOnly.recvAck(m.From, ctx)
+	if acks == nil {
+		return
+	}
+	acks[r.id] = true // the leader implicitly acks its own read
+	// Mirror handleRequestVoteResponse: both the incoming and (if a joint
+	// config change is in flight) the outgoing voter set must independently
+	// reach quorum - a learner's ack must never count toward either.
+	if !quorumGranted(r.Voters, acks) || !quorumGranted(r.votersOutgoing, acks) {
+		return
+	}
+	for _, rs := range r.readOnly.advance(ctx) {
+		r.readStates = append(r.readStates, ReadState{
+			Index:      rs.index,
+			RequestCtx: []byte(rs.req.Entries[0].Data),
+		})
+	}
+}
 
+// handleReadIndex handles a MsgReadIndex request at the leader: it records
+// the request against the current commit index and broadcasts heartbeats
+// carrying the request's context so that, once acknowledged by a quorum, we
+// know no later entry has been committed in the meantime and the recorded
+// index is safe to read at.
+func (r *Raft) handleReadIndex(m pb.Message) {
+	if r.isSoleVoter() {
+		r.readStates = append(r.readStates, ReadState{
+			Index:      r.RaftLog.committed,
+			RequestCtx: m.Entries[0].Data,
+		})
+		return
+	}
+	r.readOnly.addRequest(r.RaftLog.committed, m)
+	for peer := range r.Prs {
+		if peer == r.id {
+			continue
+		}
+		r.sendHeartbeat(peer, m.Entries[0].Data)
+	}
 }
 
 // handleSnapshot handle Snapshot RPC request
@@ -685,9 +1536,147 @@ func (r *Raft) handleSnapshot(m pb.Message) {
 // addNode add a new node to raft group
 func (r *Raft) addNode(id uint64) {
 	// Your Code Here (3A).
+	pr, ok := r.Prs[id]
+	if !ok {
+		pr = &Progress{Next: r.RaftLog.LastIndex() + 1, Inflights: newInflights(r.maxInflight)}
+		r.Prs[id] = pr
+	}
+	pr.IsLearner = false
+	r.Voters[id] = true
+	if r.State == StateLeader {
+		pr.becomeProbe()
+	}
 }
 
 // removeNode remove a node from raft group
 func (r *Raft) removeNode(id uint64) {
 	// Your Code Here (3A).
+	delete(r.Voters, id)
+	// Only drop its Progress once it's no longer tracked by any config -
+	// e.g. a removed voter might still be part of votersOutgoing until the
+	// in-flight joint change leaves.
+	if !r.votersOutgoing[id] {
+		delete(r.Prs, id)
+	}
+	if r.State == StateLeader && r.leadTransferee == id {
+		r.leadTransferee = None
+	}
+	if r.State != StateLeader {
+		return
+	}
+	if id == r.id {
+		// The leader just removed itself from the voter set: it can no
+		// longer act as leader of a configuration it isn't part of, so step
+		// down rather than risk operating on its own now-deleted Progress
+		// entry.
+		r.becomeFollower(r.Term, None)
+		return
+	}
+	// The removed peer might have been the one holding back the commit
+	// index; re-run the commit quorum check with the new, smaller voter
+	// set.
+	r.maybeCommit()
+}
+
+// addLearner adds id as a non-voting learner: it receives MsgAppend and
+// advances Match like a voter, but is excluded from vote and commit quorum
+// counting until promoteLearner makes it a voter.
+func (r *Raft) addLearner(id uint64) {
+	pr, ok := r.Prs[id]
+	if !ok {
+		pr = &Progress{Next: r.RaftLog.LastIndex() + 1, Inflights: newInflights(r.maxInflight)}
+		r.Prs[id] = pr
+	}
+	pr.IsLearner = true
+}
+
+// promoteLearner turns an existing learner into a full voter.
+func (r *Raft) promoteLearner(id uint64) {
+	if pr, ok := r.Prs[id]; ok {
+		pr.IsLearner = false
+	}
+	r.Voters[id] = true
+}
+
+// maybeCommit re-checks the commit quorum for the current voter
+// configuration(s), e.g. after the voter set shrinks.
+func (r *Raft) maybeCommit() {
+	for index := r.RaftLog.LastIndex(); index >= r.RaftLog.FirstIndex(); index-- {
+		if !r.matchQuorum(r.Voters, index) || !r.matchQuorum(r.votersOutgoing, index) {
+			continue
+		}
+		commitTerm, _ := r.RaftLog.Term(index)
+		if commitTerm == r.Term && index > r.RaftLog.committed {
+			r.reduceUncommittedSize(r.RaftLog.committed, index)
+			r.RaftLog.committed = index
+			r.broadcastAppend()
+			break
+		}
+	}
+}
+
+// confChangeType mirrors the kinds of single membership change a
+// ConfChangeV2 entry can carry.
+type confChangeType int32
+
+const (
+	confChangeAddNode confChangeType = iota
+	confChangeAddLearnerNode
+	confChangeRemoveNode
+)
+
+// confChangeSingle is one atomic step of a (possibly joint) configuration
+// change.
+type confChangeSingle struct {
+	changeType confChangeType
+	nodeID     uint64
+}
+
+func (r *Raft) applyConfChangeSingle(c confChangeSingle) {
+	switch c.changeType {
+	case confChangeAddNode:
+		r.addNode(c.nodeID)
+	case confChangeAddLearnerNode:
+		r.addLearner(c.nodeID)
+	case confChangeRemoveNode:
+		r.removeNode(c.nodeID)
+	}
+}
+
+// enterJoint starts a two-phase joint-consensus configuration change: the
+// current voter set becomes the outgoing config, changes are applied to
+// produce the incoming config, and commit/vote quorums require a majority of
+// BOTH until leaveJoint is applied. At most one joint transition may be in
+// flight at a time. index is the log index of the ConfChangeV2 entry being
+// applied, so that PendingConfIndex blocks exactly until this entry is
+// applied, not until whatever happens to be the latest entry at apply time.
+func (r *Raft) enterJoint(index uint64, autoLeave bool, changes ...confChangeSingle) error {
+	if len(r.votersOutgoing) > 0 {
+		return errors.New("cannot enter joint state while already in one")
+	}
+	r.votersOutgoing = make(map[uint64]bool, len(r.Voters))
+	for id := range r.Voters {
+		r.votersOutgoing[id] = true
+	}
+	for _, c := range changes {
+		r.applyConfChangeSingle(c)
+	}
+	r.autoLeaveJoint = autoLeave
+	r.PendingConfIndex = index
+	return nil
+}
+
+// leaveJoint drops the outgoing config, completing a joint transition: only
+// the incoming config (Voters) remains in effect afterwards.
+func (r *Raft) leaveJoint() {
+	r.votersOutgoing = nil
+	r.autoLeaveJoint = false
+	for id, pr := range r.Prs {
+		if !r.Voters[id] && !pr.IsLearner {
+			delete(r.Prs, id)
+		}
+	}
+	if r.State == StateLeader {
+		r.maybeCommit()
+	}
 }
@@ -0,0 +1,448 @@
+// Copyright 2015 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"testing"
+
+	pb "github.com/pingcap-incubator/tinykv/proto/pkg/eraftpb"
+)
+
+func newTestConfig(id uint64, peers []uint64, election, heartbeat int, storage Storage) *Config {
+	return &Config{
+		ID:            id,
+		peers:         peers,
+		ElectionTick:  election,
+		HeartbeatTick: heartbeat,
+		Storage:       storage,
+	}
+}
+
+func newTestRaft(id uint64, peers []uint64, election, heartbeat int, storage Storage) *Raft {
+	return newRaft(newTestConfig(id, peers, election, heartbeat, storage))
+}
+
+// TestPreVoteRejectsWhileLeaderLeaseActive verifies that a node which still
+// believes it has a live leader rejects a MsgPreVote even when the
+// candidate's term is higher - the scenario of a node whose own term never
+// bumped while partitioned, so its pre-vote carries Term = r.Term+1 rather
+// than Term == r.Term once it rejoins.
+func TestPreVoteRejectsWhileLeaderLeaseActive(t *testing.T) {
+	storage := NewMemoryStorage()
+	cfg := newTestConfig(1, []uint64{1, 2, 3}, 10, 1, storage)
+	cfg.PreVote = true
+	r := newRaft(cfg)
+	r.becomeFollower(5, 2)
+	r.electionElapsed = 0
+
+	r.Step(pb.Message{
+		MsgType: pb.MessageType_MsgPreVote,
+		From:    3,
+		To:      1,
+		Term:    r.Term + 1,
+		Index:   r.RaftLog.LastIndex(),
+	})
+
+	if len(r.msgs) != 1 || !r.msgs[0].Reject {
+		t.Fatalf("expected pre-vote from a higher term to be rejected while the leader's lease is active, got %+v", r.msgs)
+	}
+	if r.Lead != 2 || r.Term != 5 {
+		t.Fatalf("rejecting a pre-vote must not disturb the rejecter's term or leader, got term=%d lead=%d", r.Term, r.Lead)
+	}
+}
+
+// TestPreVoteGrantedAfterLeaderLeaseExpires verifies that once the lease
+// window (one election timeout without hearing from the leader) has
+// elapsed, a pre-vote from a higher term is granted.
+func TestPreVoteGrantedAfterLeaderLeaseExpires(t *testing.T) {
+	storage := NewMemoryStorage()
+	cfg := newTestConfig(1, []uint64{1, 2, 3}, 10, 1, storage)
+	cfg.PreVote = true
+	r := newRaft(cfg)
+	r.becomeFollower(5, 2)
+	r.electionElapsed = r.electionTimeout
+
+	r.Step(pb.Message{
+		MsgType: pb.MessageType_MsgPreVote,
+		From:    3,
+		To:      1,
+		Term:    r.Term + 1,
+		Index:   r.RaftLog.LastIndex(),
+	})
+
+	if len(r.msgs) != 1 || r.msgs[0].Reject {
+		t.Fatalf("expected pre-vote to be granted once the leader's lease has expired, got %+v", r.msgs)
+	}
+}
+
+// TestReadIndexRequiresHeartbeatQuorum verifies that a leader only surfaces
+// a ReadState once a quorum of peers has acknowledged, via the heartbeat
+// Context round-trip, that no later entry could have committed in the
+// meantime.
+func TestReadIndexRequiresHeartbeatQuorum(t *testing.T) {
+	storage := NewMemoryStorage()
+	r := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, storage)
+	r.becomeCandidate()
+	r.becomeLeader()
+	r.RaftLog.committed = r.RaftLog.LastIndex()
+	r.msgs = nil
+
+	ctx := []byte("read-ctx")
+	r.Step(pb.Message{
+		MsgType: pb.MessageType_MsgReadIndex,
+		From:    1,
+		Entries: []*pb.Entry{{Data: ctx}},
+	})
+	if len(r.readStates) != 0 {
+		t.Fatalf("expected no ReadState before a quorum of heartbeat acks, got %+v", r.readStates)
+	}
+
+	r.Step(pb.Message{MsgType: pb.MessageType_MsgHeartbeatResponse, From: 2, Context: ctx})
+	if len(r.readStates) != 1 {
+		t.Fatalf("expected one ReadState once a quorum (leader + 1 follower) acked, got %d", len(r.readStates))
+	}
+	if string(r.readStates[0].RequestCtx) != string(ctx) {
+		t.Fatalf("ReadState carried the wrong context: %q", r.readStates[0].RequestCtx)
+	}
+}
+
+// TestReadIndexSoleVoterAnswersImmediately verifies that a single-node
+// cluster's leader doesn't wait on a heartbeat round-trip it can never need.
+func TestReadIndexSoleVoterAnswersImmediately(t *testing.T) {
+	storage := NewMemoryStorage()
+	r := newTestRaft(1, []uint64{1}, 10, 1, storage)
+	r.becomeCandidate()
+	r.becomeLeader()
+
+	ctx := []byte("solo-ctx")
+	r.Step(pb.Message{
+		MsgType: pb.MessageType_MsgReadIndex,
+		From:    1,
+		Entries: []*pb.Entry{{Data: ctx}},
+	})
+
+	if len(r.readStates) != 1 {
+		t.Fatalf("expected the sole voter to answer its own ReadIndex immediately, got %+v", r.readStates)
+	}
+}
+
+// TestReadIndexIgnoresLearnerAcks verifies that a learner's heartbeat ack
+// never counts toward the ReadIndex quorum: with 3 voters (1, 2, 3) and a
+// learner (4), only the leader (1) plus the learner acking must not be
+// enough to surface a ReadState - that requires a real majority of voters.
+func TestReadIndexIgnoresLearnerAcks(t *testing.T) {
+	storage := NewMemoryStorage()
+	r := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, storage)
+	r.becomeCandidate()
+	r.becomeLeader()
+	r.addLearner(4)
+
+	ctx := []byte("learner-ctx")
+	r.Step(pb.Message{
+		MsgType: pb.MessageType_MsgReadIndex,
+		From:    1,
+		Entries: []*pb.Entry{{Data: ctx}},
+	})
+
+	r.Step(pb.Message{MsgType: pb.MessageType_MsgHeartbeatResponse, From: 4, Context: ctx})
+	if len(r.readStates) != 0 {
+		t.Fatalf("a learner's ack must not count toward the ReadIndex quorum, got %+v", r.readStates)
+	}
+
+	r.Step(pb.Message{MsgType: pb.MessageType_MsgHeartbeatResponse, From: 2, Context: ctx})
+	if len(r.readStates) != 1 {
+		t.Fatalf("expected a real voter's ack to complete the quorum, got %+v", r.readStates)
+	}
+}
+
+// TestProgressBecomesProbeOnRejection verifies that a rejected
+// MsgAppendResponse moves the peer back to StateProbe (clearing its
+// Inflights window) rather than leaving it stuck in StateReplicate with
+// stale in-flight entries still counting toward Full().
+func TestProgressBecomesProbeOnRejection(t *testing.T) {
+	storage := NewMemoryStorage()
+	r := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, storage)
+	r.becomeCandidate()
+	r.becomeLeader()
+
+	pr := r.Prs[2]
+	pr.becomeReplicate()
+	pr.Inflights.Add(5)
+	pr.Inflights.Add(6)
+
+	r.Step(pb.Message{
+		MsgType: pb.MessageType_MsgAppendResponse,
+		From:    2,
+		Reject:  true,
+		Index:   6,
+	})
+
+	if pr.State != StateProbe {
+		t.Fatalf("expected a rejected append to move the peer back to StateProbe, got %s", pr.State)
+	}
+	if pr.Inflights.count != 0 {
+		t.Fatalf("expected becomeProbe to clear the Inflights window, got %d still in flight", pr.Inflights.count)
+	}
+}
+
+// TestProgressPipelinesWithinInflightWindow verifies that a peer in
+// StateReplicate is only paused once its Inflights window is full.
+func TestProgressPipelinesWithinInflightWindow(t *testing.T) {
+	storage := NewMemoryStorage()
+	r := newTestRaft(1, []uint64{1, 2}, 10, 1, storage)
+	r.becomeCandidate()
+	r.becomeLeader()
+
+	pr := r.Prs[2]
+	pr.becomeReplicate()
+	for i := 0; i < r.maxInflight; i++ {
+		r.RaftLog.entries = append(r.RaftLog.entries, pb.Entry{Term: r.Term, Index: r.RaftLog.LastIndex() + 1})
+		if !r.sendAppend(2) {
+			t.Fatalf("expected sendAppend to succeed while the inflight window has room (i=%d)", i)
+		}
+	}
+	if !pr.Inflights.Full() {
+		t.Fatalf("expected the inflight window to be full after maxInflight sends")
+	}
+	r.RaftLog.entries = append(r.RaftLog.entries, pb.Entry{Term: r.Term, Index: r.RaftLog.LastIndex() + 1})
+	if r.sendAppend(2) {
+		t.Fatalf("expected sendAppend to pause once the inflight window is full")
+	}
+}
+
+// TestSendAppendPausesOnCompactedPrevLogIndex verifies that sendAppend moves
+// a peer to StateSnapshot and sends a MsgSnapshot, instead of sending a
+// MsgAppend with a bogus LogTerm, once the peer's Next has fallen behind
+// what's been compacted out of the log.
+func TestSendAppendPausesOnCompactedPrevLogIndex(t *testing.T) {
+	storage := NewMemoryStorage()
+	for i := uint64(1); i <= 5; i++ {
+		storage.Append([]pb.Entry{{Term: 1, Index: i}})
+	}
+	storage.Compact(5)
+	r := newTestRaft(1, []uint64{1, 2}, 10, 1, storage)
+	r.becomeCandidate()
+	r.becomeLeader()
+
+	pr := r.Prs[2]
+	// becomeLeader's own append already paused this peer; start a fresh probe.
+	pr.becomeProbe()
+	pr.Next = 2 // already compacted away
+
+	r.msgs = nil
+	if !r.sendAppend(2) {
+		t.Fatalf("expected sendAppend to send a snapshot rather than return false")
+	}
+	if pr.State != StateSnapshot {
+		t.Fatalf("expected the peer to move to StateSnapshot, got %s", pr.State)
+	}
+	if len(r.msgs) != 1 || r.msgs[0].MsgType != pb.MessageType_MsgSnapshot {
+		t.Fatalf("expected a single MsgSnapshot, got %+v", r.msgs)
+	}
+}
+
+// TestJointConfigRequiresBothQuorums verifies that, while a joint
+// configuration change is in flight, an entry only commits once it has a
+// majority of both the incoming and outgoing voter sets.
+func TestJointConfigRequiresBothQuorums(t *testing.T) {
+	storage := NewMemoryStorage()
+	r := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, storage)
+	r.becomeCandidate()
+	r.becomeLeader()
+
+	if err := r.enterJoint(r.RaftLog.LastIndex(), false, confChangeSingle{changeType: confChangeRemoveNode, nodeID: 3}, confChangeSingle{changeType: confChangeAddNode, nodeID: 4}); err != nil {
+		t.Fatalf("enterJoint failed: %v", err)
+	}
+
+	index := r.RaftLog.LastIndex()
+	// The leader (1) already matches index. With 4's ack only the incoming
+	// config (1, 2, 4) has a majority; the outgoing config (1, 2, 3) does not
+	// include 4, so it still needs 2's or 3's ack too.
+	r.Prs[4].Match = index
+	if r.matchQuorum(r.votersOutgoing, index) {
+		t.Fatalf("outgoing config should not yet have reached quorum on index %d", index)
+	}
+
+	r.Prs[3].Match = index
+	if !r.matchQuorum(r.votersOutgoing, index) || !r.matchQuorum(r.Voters, index) {
+		t.Fatalf("expected both configs to reach quorum once 3 also acked index %d", index)
+	}
+}
+
+// TestRemoveNodeSelfStepsDownInsteadOfPanicking verifies that a leader
+// applying a committed conf change that removes itself steps down rather
+// than deleting its own Progress entry out from under handlePropose.
+func TestRemoveNodeSelfStepsDownInsteadOfPanicking(t *testing.T) {
+	storage := NewMemoryStorage()
+	r := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, storage)
+	r.becomeCandidate()
+	r.becomeLeader()
+
+	r.removeNode(1)
+
+	if r.State != StateFollower {
+		t.Fatalf("expected the leader to step down after removing itself, got %s", r.State)
+	}
+	if _, ok := r.Voters[1]; ok {
+		t.Fatalf("expected self to be dropped from Voters")
+	}
+}
+
+// TestPendingConfIndexPinnedToConfChangeEntry verifies that enterJoint
+// blocks the next conf change until the conf-change entry it was given is
+// applied, not until whatever the latest log entry happens to be once the
+// change is actually applied.
+func TestPendingConfIndexPinnedToConfChangeEntry(t *testing.T) {
+	storage := NewMemoryStorage()
+	r := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, storage)
+	r.becomeCandidate()
+	r.becomeLeader()
+
+	confChangeIndex := r.RaftLog.LastIndex() + 1
+	if err := r.enterJoint(confChangeIndex, false, confChangeSingle{changeType: confChangeAddLearnerNode, nodeID: 4}); err != nil {
+		t.Fatalf("enterJoint failed: %v", err)
+	}
+
+	if r.PendingConfIndex != confChangeIndex {
+		t.Fatalf("expected PendingConfIndex to be pinned to the conf-change entry's own index %d, got %d", confChangeIndex, r.PendingConfIndex)
+	}
+}
+
+// TestUncommittedSizeShedsLoadOnceCapped verifies that a leader rejects
+// proposals once the uncommitted log tail would exceed MaxUncommittedEntriesSize,
+// and that committing the tail frees the budget back up. Follower 2 stays
+// silent until the end, so nothing commits in between.
+func TestUncommittedSizeShedsLoadOnceCapped(t *testing.T) {
+	storage := NewMemoryStorage()
+	cfg := newTestConfig(1, []uint64{1, 2}, 10, 1, storage)
+	cfg.MaxUncommittedEntriesSize = 12
+	r := newRaft(cfg)
+	r.becomeCandidate()
+	r.becomeLeader()
+
+	if err := r.handlePropose(pb.Message{Entries: []*pb.Entry{{Data: []byte("0123456789")}}}); err != nil {
+		t.Fatalf("expected the first proposal to fit under the cap, got %v", err)
+	}
+	if err := r.handlePropose(pb.Message{Entries: []*pb.Entry{{Data: []byte("abcde")}}}); err != ErrProposalDropped {
+		t.Fatalf("expected a proposal pushing the tail over the cap to be dropped, got %v", err)
+	}
+
+	r.Step(pb.Message{MsgType: pb.MessageType_MsgAppendResponse, From: 2, Term: r.Term, Index: r.RaftLog.LastIndex()})
+	if err := r.handlePropose(pb.Message{Entries: []*pb.Entry{{Data: []byte("abcde")}}}); err != nil {
+		t.Fatalf("expected committing the tail to free the budget, got %v", err)
+	}
+}
+
+// TestUncommittedSizeDoesNotLeakOnDroppedConfChange verifies that a
+// ConfChangeV2 entry dropped because another conf change is already
+// pending doesn't still get charged against uncommittedSize - otherwise
+// those bytes could never be reclaimed by reduceUncommittedSize, since the
+// entry is never appended or committed.
+func TestUncommittedSizeDoesNotLeakOnDroppedConfChange(t *testing.T) {
+	storage := NewMemoryStorage()
+	cfg := newTestConfig(1, []uint64{1}, 10, 1, storage)
+	cfg.MaxUncommittedEntriesSize = 1000
+	r := newRaft(cfg)
+	r.becomeCandidate()
+	r.becomeLeader()
+
+	r.PendingConfIndex = r.RaftLog.LastIndex() + 1 // pretend a conf change is already pending
+
+	before := r.uncommittedSize
+	if err := r.handlePropose(pb.Message{Entries: []*pb.Entry{
+		{EntryType: pb.EntryType_EntryConfChangeV2, Data: []byte("dropped-conf-change")},
+	}}); err != nil {
+		t.Fatalf("handlePropose returned an error: %v", err)
+	}
+	if r.uncommittedSize != before {
+		t.Fatalf("expected a dropped conf-change entry to leave uncommittedSize unchanged, got %d -> %d", before, r.uncommittedSize)
+	}
+}
+
+// TestTransferLeaderToCaughtUpPeerSendsTimeoutNow verifies that a transfer
+// to a peer that's already caught up hands off immediately via
+// MsgTimeoutNow instead of waiting for a round of replication.
+func TestTransferLeaderToCaughtUpPeerSendsTimeoutNow(t *testing.T) {
+	storage := NewMemoryStorage()
+	r := newTestRaft(1, []uint64{1, 2}, 10, 1, storage)
+	r.becomeCandidate()
+	r.becomeLeader()
+	r.Prs[2].Match = r.RaftLog.LastIndex()
+
+	r.msgs = nil
+	r.Step(pb.Message{MsgType: pb.MessageType_MsgTransferLeader, From: 2})
+
+	if len(r.msgs) != 1 || r.msgs[0].MsgType != pb.MessageType_MsgTimeoutNow {
+		t.Fatalf("expected an immediate MsgTimeoutNow, got %+v", r.msgs)
+	}
+	if r.leadTransferee != 2 {
+		t.Fatalf("expected leadTransferee to be set to the transfer target")
+	}
+}
+
+// TestTransferLeaderRejectsLearner verifies that leadership can't be
+// transferred to a non-voting learner - it would never be eligible to win
+// the election MsgTimeoutNow triggers.
+func TestTransferLeaderRejectsLearner(t *testing.T) {
+	storage := NewMemoryStorage()
+	r := newTestRaft(1, []uint64{1, 2}, 10, 1, storage)
+	r.becomeCandidate()
+	r.becomeLeader()
+	r.addLearner(3)
+	r.Prs[3].Match = r.RaftLog.LastIndex()
+
+	r.msgs = nil
+	r.Step(pb.Message{MsgType: pb.MessageType_MsgTransferLeader, From: 3})
+
+	if len(r.msgs) != 0 {
+		t.Fatalf("expected no messages when transferring to a learner, got %+v", r.msgs)
+	}
+	if r.leadTransferee != None {
+		t.Fatalf("expected leadTransferee to remain unset when the target is a learner")
+	}
+}
+
+// TestTransferLeaderAbortsAfterElectionTimeout verifies that an in-flight
+// transfer to a peer that never catches up is abandoned after one election
+// timeout, even with CheckQuorum also enabled - the two features must not
+// share a reset that stops either timer from ever firing.
+func TestTransferLeaderAbortsAfterElectionTimeout(t *testing.T) {
+	storage := NewMemoryStorage()
+	cfg := newTestConfig(1, []uint64{1, 2, 3}, 10, 1, storage)
+	cfg.CheckQuorum = true
+	r := newRaft(cfg)
+	r.becomeCandidate()
+	r.becomeLeader()
+	r.recentActive[2] = true
+	r.recentActive[3] = true
+
+	r.Step(pb.Message{MsgType: pb.MessageType_MsgTransferLeader, From: 2})
+	if r.leadTransferee != 2 {
+		t.Fatalf("expected leadTransferee to be set")
+	}
+
+	for i := 0; i < cfg.ElectionTick; i++ {
+		r.recentActive[2] = true
+		r.recentActive[3] = true
+		r.tick()
+	}
+
+	if r.leadTransferee != None {
+		t.Fatalf("expected the stalled transfer to be abandoned after one election timeout")
+	}
+	if r.State != StateLeader {
+		t.Fatalf("expected the leader to remain leader since a quorum stayed active, got %s", r.State)
+	}
+}